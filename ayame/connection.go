@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"strings"
 	"sync"
 	"time"
 
@@ -40,6 +41,15 @@ type Connection struct {
 	// 送信する認証用のメタデータ
 	AuthnMetadata *interface{}
 
+	// pion の SettingEngine。エフェメラルな UDP ポート範囲、ICE のタイムアウト、
+	// NetworkTypes、mDNS、NAT1To1IPs などコンテナ内や NAT 環境で必要になる設定を行えます。
+	// 未指定の場合は defaultSettingEngine が使われます。
+	SettingEngine *webrtc.SettingEngine
+
+	// EXIT-RECV / READ-RTP-ERROR / ICE-CONNECTION-STATE-FAILED が発生した際の自動再接続ポリシー。
+	// nil の場合、これらのイベントは従来通り即座に OnDisconnect を呼び出します。
+	ReconnectPolicy *ReconnectPolicy
+
 	// MediaStream API is not yet fully supported by pion.
 	// Only working on Linux machine
 	// Check development status of https://github.com/pion/mediadevices
@@ -56,11 +66,44 @@ type Connection struct {
 	isOffer       bool
 	isExistClient bool
 
-	onOpenHandler        func(metadata *interface{})
-	onConnectHandler     func()
-	onDisconnectHandler  func(reason string, err error)
-	onTrackPacketHandler func(track *webrtc.Track, packet *rtp.Packet)
-	onByeHandler         func()
+	// SetRemoteDescription が完了するまでに受信した ICE candidate を溜めておくキュー
+	pendingCandidates    []webrtc.ICECandidateInit
+	remoteDescriptionSet bool
+	candidateMu          sync.Mutex
+
+	onOpenHandler             func(metadata *interface{})
+	onConnectHandler          func()
+	onDisconnectHandler       func(reason string, err error)
+	onTrackPacketHandler      func(track *webrtc.Track, packet *rtp.Packet)
+	onByeHandler              func()
+	onKeyFrameRequiredHandler func(mediaSSRC uint32)
+	onReconnectingHandler     func(attempt int, err error)
+	onReconnectedHandler      func()
+	onDataChannelHandler      func(dc *webrtc.DataChannel)
+
+	// closed はユーザーによる Disconnect() あるいはサーバーからの bye によって
+	// 接続が意図的に終了されたことを表します。true の間は EXIT-RECV などの
+	// fatal error を受けても reconnectLoop を開始しません。
+	closed bool
+
+	// generation は disconnect() のたびにインクリメントされる世代カウンタです。
+	// recv() や createPeerConnection() のゴルーチンは開始時点の generation を憶えておき、
+	// handleFatalError に渡します。reconnectLoop が disconnect(false) で古い ws/pc を
+	// 意図的に畳むと、その世代の recv()/pc コールバックは後から EXIT-RECV や
+	// READ-RTP-ERROR を報告してきますが、これは新しい世代の再接続とは無関係なので、
+	// generation が一致しないイベントは handleFatalError 内で無視します。
+	generation int
+
+	reconnecting     bool
+	reconnectOutcome chan error
+
+	// アクティブな DataChannel を保持しておくためのスライス。pion v2 にロールバックはないため、
+	// glare で PeerConnection を再構築すると旧 PeerConnection 上の DataChannel オブジェクト
+	// 自体は失われます。CreateDataChannel で作成したもの（init が非 nil）は label/init を
+	// 憶えておき、再構築後の PeerConnection 上で作り直して OnDataChannel 経由で通知します。
+	// リモートが作成したもの（init が nil）は再構築後こちら側からは作り直せないため破棄されます。
+	dataChannels  []*dataChannelState
+	dataChannelMu sync.Mutex
 
 	callbackMu sync.Mutex
 }
@@ -71,15 +114,42 @@ func (c *Connection) Connect() error {
 		c.trace("connection already exists")
 		return fmt.Errorf("connection alreay exists")
 	}
+	c.callbackMu.Lock()
+	c.closed = false
+	c.callbackMu.Unlock()
 	c.signaling()
 	return nil
 }
 
-// Disconnect は PeerConnection 接続を切断します。
+// Disconnect は PeerConnection 接続を切断します。closed を立てることで、切断に伴って
+// EXIT-RECV などが発生しても reconnectLoop が起動しないようにし、進行中の
+// reconnectLoop があれば reconnectOutcome へ terminal error を送って抜けさせます。
 func (c *Connection) Disconnect() {
+	c.callbackMu.Lock()
+	c.closed = true
+	c.reconnecting = false
+	outcome := c.reconnectOutcome
+	c.callbackMu.Unlock()
+
+	if outcome != nil {
+		select {
+		case outcome <- &reconnectTerminalError{reason: "DISCONNECTED"}:
+		default:
+		}
+	}
+
+	c.disconnect(true)
+}
+
+// disconnect は PC/WS を畳んで内部状態をリセットします。clearHandlers が false の場合、
+// ユーザーが OnXxx で設定したコールバックは保持したままにします。再接続中に
+// 一時的に接続を畳む際に使われます。
+func (c *Connection) disconnect(clearHandlers bool) {
 	c.callbackMu.Lock()
 	defer c.callbackMu.Unlock()
 
+	c.generation++
+
 	c.closePeerConnection()
 	c.closeWebSocketConnection()
 	c.authzMetadata = nil
@@ -88,11 +158,28 @@ func (c *Connection) Disconnect() {
 	c.isOffer = false
 	c.isExistClient = false
 
+	c.candidateMu.Lock()
+	c.pendingCandidates = nil
+	c.remoteDescriptionSet = false
+	c.candidateMu.Unlock()
+
+	c.dataChannelMu.Lock()
+	c.dataChannels = nil
+	c.dataChannelMu.Unlock()
+
+	if !clearHandlers {
+		return
+	}
+
 	c.onOpenHandler = func(metadata *interface{}) {}
 	c.onConnectHandler = func() {}
 	c.onDisconnectHandler = func(reason string, err error) {}
 	c.onTrackPacketHandler = func(track *webrtc.Track, packet *rtp.Packet) {}
 	c.onByeHandler = func() {}
+	c.onKeyFrameRequiredHandler = func(mediaSSRC uint32) {}
+	c.onReconnectingHandler = func(attempt int, err error) {}
+	c.onReconnectedHandler = func() {}
+	c.onDataChannelHandler = func(dc *webrtc.DataChannel) {}
 }
 
 // OnOpen は open イベント発生時のコールバック関数を設定します。
@@ -130,6 +217,73 @@ func (c *Connection) OnBye(f func()) {
 	c.onByeHandler = f
 }
 
+// OnKeyFrameRequired は AddLocalTrack で追加したローカルトラックに対して
+// リモートから PLI/FIR によるキーフレーム要求を受け取った際のコールバック関数を設定します。
+func (c *Connection) OnKeyFrameRequired(f func(mediaSSRC uint32)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.onKeyFrameRequiredHandler = f
+}
+
+// OnDataChannel はリモートが作成した DataChannel を受信した際のコールバック関数を設定します。
+// glare で PeerConnection を再構築した際に、CreateDataChannel で作成した DataChannel を
+// 作り直した場合にも新しい DataChannel を渡して呼び出されます。
+func (c *Connection) OnDataChannel(f func(dc *webrtc.DataChannel)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.onDataChannelHandler = f
+}
+
+// dataChannelState は管理下の DataChannel を、PeerConnection が再構築された際に
+// 作り直せるように label/init とともに憶えておくためのレコードです。init はこちら側が
+// CreateDataChannel で作成した場合にのみ設定され、リモートが作成した DataChannel (init == nil)
+// は再構築後にこちら側から作り直すことはできません。
+type dataChannelState struct {
+	dc    *webrtc.DataChannel
+	label string
+	init  *webrtc.DataChannelInit
+}
+
+// CreateDataChannel はアプリケーションメッセージング用の SCTP DataChannel を作成します。
+// glare によって PeerConnection が再構築される場合、pion v2 にロールバックはないため
+// このメソッドで作成した DataChannel オブジェクト自体は失われますが、label/init を
+// 憶えておき再構築後の PeerConnection 上で作り直した上で OnDataChannel 経由で新しい
+// DataChannel を通知します。
+func (c *Connection) CreateDataChannel(label string, init *webrtc.DataChannelInit) (*webrtc.DataChannel, error) {
+	if c.pc == nil {
+		return nil, fmt.Errorf("PeerConnection is not established yet")
+	}
+
+	dc, err := c.pc.CreateDataChannel(label, init)
+	if err != nil {
+		return nil, err
+	}
+	c.trackDataChannel(dc, label, init)
+	return dc, nil
+}
+
+// trackDataChannel は DataChannel を dataChannels に登録し、閉じられたら取り除きます。
+// init はこちら側が CreateDataChannel で作成した場合のみ渡され、リモートが作成した
+// DataChannel を pc.OnDataChannel から登録する場合は nil を渡します。
+func (c *Connection) trackDataChannel(dc *webrtc.DataChannel, label string, init *webrtc.DataChannelInit) {
+	state := &dataChannelState{dc: dc, label: label, init: init}
+
+	c.dataChannelMu.Lock()
+	c.dataChannels = append(c.dataChannels, state)
+	c.dataChannelMu.Unlock()
+
+	dc.OnClose(func() {
+		c.dataChannelMu.Lock()
+		defer c.dataChannelMu.Unlock()
+		for i, existing := range c.dataChannels {
+			if existing.dc == dc {
+				c.dataChannels = append(c.dataChannels[:i], c.dataChannels[i+1:]...)
+				break
+			}
+		}
+	})
+}
+
 func (c *Connection) trace(format string, v ...interface{}) {
 	if c.Debug {
 		logf(format, v...)
@@ -152,7 +306,11 @@ func (c *Connection) signaling() error {
 	ctx, cancel := context.WithCancel(ctx)
 	messageChannel := make(chan []byte, 100)
 
-	go c.recv(ctx, messageChannel)
+	c.callbackMu.Lock()
+	generation := c.generation
+	c.callbackMu.Unlock()
+
+	go c.recv(ctx, messageChannel, generation)
 	go c.main(cancel, messageChannel)
 
 	return c.sendRegisterMessage()
@@ -220,25 +378,117 @@ func (c *Connection) sendSdp(sessionDescription *webrtc.SessionDescription) {
 	c.sendMsg(sessionDescription)
 }
 
-func (c *Connection) createPeerConnection() error {
-	if c.Options.Video.Codec != "VP8" {
-		return fmt.Errorf("Unsupported Video Codec: %s", c.Options.Video.Codec)
+// CodecRegistrar は MediaEngine へコーデックを登録する関数です。ConnectionOptions.CodecRegistrar が
+// 未指定の場合は defaultCodecRegistrar が使われ、Options.Video.Codec / Options.Audio.Codec に
+// 応じて VP8/VP9/H264、Opus/G722/PCMU/PCMA のいずれか（未指定時は VP8 + Opus）を登録します。
+// 独自の CodecRegistrar を渡すことで、独自のペイロードタイプ・クロックレート・fmtp を持つ
+// コーデックを登録することもできます。
+type CodecRegistrar func(m *webrtc.MediaEngine, video ConnectionVideoOption, audio ConnectionAudioOption) error
+
+// UnsupportedCodecError は Options.Video.Codec / Options.Audio.Codec に指定されたコーデックが
+// CodecRegistrar でサポートされていない場合に返されるエラーです。
+type UnsupportedCodecError struct {
+	Kind  string // "video" または "audio"
+	Codec string
+}
+
+func (e *UnsupportedCodecError) Error() string {
+	return fmt.Sprintf("unsupported %s codec: %s", e.Kind, e.Codec)
+}
+
+// defaultCodecRegistrar は VP8/VP9/H264 と Opus/G722/PCMU/PCMA をサポートする既定の CodecRegistrar です。
+// PayloadType が指定されていれば pion の既定ペイロードタイプの代わりにそれを使います。
+func defaultCodecRegistrar(m *webrtc.MediaEngine, video ConnectionVideoOption, audio ConnectionAudioOption) error {
+	videoPT := video.PayloadType
+	switch video.Codec {
+	case "", "VP8":
+		if videoPT == 0 {
+			videoPT = webrtc.DefaultPayloadTypeVP8
+		}
+		m.RegisterCodec(webrtc.NewRTPVP8Codec(videoPT, 90000))
+	case "VP9":
+		if videoPT == 0 {
+			videoPT = webrtc.DefaultPayloadTypeVP9
+		}
+		m.RegisterCodec(webrtc.NewRTPVP9Codec(videoPT, 90000))
+	case "H264":
+		if videoPT == 0 {
+			videoPT = webrtc.DefaultPayloadTypeH264
+		}
+		m.RegisterCodec(webrtc.NewRTPH264Codec(videoPT, 90000))
+	default:
+		return &UnsupportedCodecError{Kind: "video", Codec: video.Codec}
 	}
 
+	audioPT := audio.PayloadType
+	switch audio.Codec {
+	case "", "OPUS":
+		if audioPT == 0 {
+			audioPT = webrtc.DefaultPayloadTypeOpus
+		}
+		m.RegisterCodec(webrtc.NewRTPOpusCodec(audioPT, 48000))
+	case "G722":
+		if audioPT == 0 {
+			audioPT = webrtc.DefaultPayloadTypeG722
+		}
+		m.RegisterCodec(webrtc.NewRTPG722Codec(audioPT, 8000))
+	case "PCMU":
+		if audioPT == 0 {
+			audioPT = webrtc.DefaultPayloadTypePCMU
+		}
+		m.RegisterCodec(webrtc.NewRTPPCMUCodec(audioPT, 8000))
+	case "PCMA":
+		if audioPT == 0 {
+			audioPT = webrtc.DefaultPayloadTypePCMA
+		}
+		m.RegisterCodec(webrtc.NewRTPPCMACodec(audioPT, 8000))
+	default:
+		return &UnsupportedCodecError{Kind: "audio", Codec: audio.Codec}
+	}
+	return nil
+}
+
+// defaultSettingEngine は neko プロジェクトの値を参考にした ICE タイムアウトを設定した
+// SettingEngine を返します。コンテナ内やファイアウォール配下での利用を想定したデフォルトです。
+func defaultSettingEngine() *webrtc.SettingEngine {
+	s := webrtc.SettingEngine{}
+	s.SetICETimeouts(4*time.Second, 6*time.Second, 2*time.Second)
+	return &s
+}
+
+func (c *Connection) createPeerConnection() error {
 	// createPeerConnection() は以下のソース内の createWebRTCConn() を参考に記述しました。
 	// 引用した部分については、コメントもそのまま持ってきています。
 	// https://github.com/pion/example-webrtc-applications/blob/master/save-to-webm/main.go
 
+	c.callbackMu.Lock()
+	generation := c.generation
+	c.callbackMu.Unlock()
+
 	// Create a MediaEngine object to configure the supported codec
 	m := webrtc.MediaEngine{}
 
-	// Setup the codecs you want to use.
-	// Only support VP8 and OPUS, this makes our WebM muxer code simpler
-	m.RegisterCodec(webrtc.NewRTPVP8Codec(webrtc.DefaultPayloadTypeVP8, 90000))
-	m.RegisterCodec(webrtc.NewRTPOpusCodec(webrtc.DefaultPayloadTypeOpus, 48000))
+	// Setup the codecs you want to use. Options.CodecRegistrar が指定されていればそちらに委譲し、
+	// 未指定であれば Options.Video.Codec / Options.Audio.Codec に応じて VP8/VP9/H264 と
+	// Opus/G722/PCMU/PCMA から選択して登録する defaultCodecRegistrar を使う
+	registrar := c.Options.CodecRegistrar
+	if registrar == nil {
+		registrar = defaultCodecRegistrar
+	}
+	if err := registrar(&m, c.Options.Video, c.Options.Audio); err != nil {
+		return err
+	}
+
+	settingEngine := c.SettingEngine
+	if settingEngine == nil {
+		settingEngine = defaultSettingEngine()
+	}
 
-	// Create the API object with the MediaEngine
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(m))
+	// Create the API object with the MediaEngine and SettingEngine.
+	// pion/webrtc v2 には Interceptor registry が存在しないため、NACK/TWCC/カスタム RTCP
+	// interceptor を差し込む口はここでは提供できません（v3 以降でのみ webrtc.WithInterceptorRegistry
+	// が使えます）。
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithSettingEngine(*settingEngine))
 
 	// Create a new RTCPeerConnection
 	c.trace("RTCConfiguration: %v", c.pcConfig)
@@ -248,13 +498,17 @@ func (c *Connection) createPeerConnection() error {
 	}
 
 	if c.Options.Audio.Enabled {
-		if _, err = pc.AddTransceiver(webrtc.RTPCodecTypeAudio); err != nil {
+		if _, err = pc.AddTransceiver(webrtc.RTPCodecTypeAudio, webrtc.RtpTransceiverInit{
+			Direction: rtpTransceiverDirection(c.Options.Audio.Direction),
+		}); err != nil {
 			return err
 		}
 	}
 
 	if c.Options.Video.Enabled {
-		if _, err = pc.AddTransceiver(webrtc.RTPCodecTypeVideo); err != nil {
+		if _, err = pc.AddTransceiver(webrtc.RTPCodecTypeVideo, webrtc.RtpTransceiverInit{
+			Direction: rtpTransceiverDirection(c.Options.Video.Direction),
+		}); err != nil {
 			return err
 		}
 	}
@@ -287,8 +541,7 @@ func (c *Connection) createPeerConnection() error {
 						return
 					}
 					c.trace("read RTP error %v", readErr)
-					c.Disconnect()
-					c.onDisconnectHandler("READ-RTP-ERROR", err)
+					c.handleFatalError("READ-RTP-ERROR", readErr, generation)
 					return
 				}
 				c.onTrackPacketHandler(track, rtp)
@@ -309,11 +562,20 @@ func (c *Connection) createPeerConnection() error {
 			case webrtc.ICEConnectionStateConnected:
 				c.isOffer = false
 				c.onConnectHandler()
+				c.callbackMu.Lock()
+				reconnecting := c.reconnecting
+				outcome := c.reconnectOutcome
+				c.callbackMu.Unlock()
+				if reconnecting && outcome != nil {
+					select {
+					case outcome <- errReconnectSuccess:
+					default:
+					}
+				}
 			case webrtc.ICEConnectionStateDisconnected:
 				fallthrough
 			case webrtc.ICEConnectionStateFailed:
-				c.Disconnect()
-				c.onDisconnectHandler("ICE-CONNECTION-STATE-FAILED", nil)
+				c.handleFatalError("ICE-CONNECTION-STATE-FAILED", nil, generation)
 			}
 		}
 	})
@@ -321,6 +583,30 @@ func (c *Connection) createPeerConnection() error {
 	pc.OnSignalingStateChange(func(signalingState webrtc.SignalingState) {
 		c.trace("signaling state changes: %s", signalingState.String())
 	})
+	// リモートが作成した DataChannel を受け取る
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		c.trace("peerConnection.ondatachannel(): %s", dc.Label())
+		c.trackDataChannel(dc, dc.Label(), nil)
+		c.onDataChannelHandler(dc)
+	})
+	// Trickle ICE: pion が集めたローカル候補を都度シグナリングチャネルへ流す。
+	// 候補集めの完了は candidate が nil で通知されるので、その場合は candidateMessage を送らない。
+	c.candidateMu.Lock()
+	c.pendingCandidates = nil
+	c.remoteDescriptionSet = false
+	c.candidateMu.Unlock()
+	pc.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			c.trace("ICE candidate gathering complete")
+			return
+		}
+		init := candidate.ToJSON()
+		c.trace("local ICE candidate: %v", init)
+		c.sendMsg(&candidateMessage{
+			Type:         "candidate",
+			ICECandidate: &init,
+		})
+	})
 
 	if c.pc != nil {
 		c.pc = pc
@@ -331,6 +617,71 @@ func (c *Connection) createPeerConnection() error {
 	return nil
 }
 
+// rtpTransceiverDirection は ConnectionVideoOption / ConnectionAudioOption の Direction 文字列を
+// webrtc.RTPTransceiverDirection に変換します。未指定・不明な値は recvonly として扱います。
+func rtpTransceiverDirection(direction string) webrtc.RTPTransceiverDirection {
+	switch direction {
+	case "sendonly":
+		return webrtc.RTPTransceiverDirectionSendonly
+	case "sendrecv":
+		return webrtc.RTPTransceiverDirectionSendrecv
+	default:
+		return webrtc.RTPTransceiverDirectionRecvonly
+	}
+}
+
+// AddLocalTrack は sendonly / sendrecv で動作させる際にローカルのメディアトラックを
+// PeerConnection に追加し、送信を開始します。返り値の RTPSender からはリモートが要求する
+// キーフレーム (PLI/FIR) が読み取られ、OnKeyFrameRequired に通知されます。
+func (c *Connection) AddLocalTrack(track *webrtc.Track) (*webrtc.RTPSender, error) {
+	if c.pc == nil {
+		return nil, fmt.Errorf("PeerConnection is not established yet")
+	}
+
+	sender, err := c.pc.AddTrack(track)
+	if err != nil {
+		return nil, err
+	}
+	c.watchSenderRTCP(sender)
+	return sender, nil
+}
+
+// RemoveLocalTrack は AddLocalTrack で追加したトラックの送信を停止します。
+func (c *Connection) RemoveLocalTrack(sender *webrtc.RTPSender) error {
+	if c.pc == nil {
+		return fmt.Errorf("PeerConnection is not established yet")
+	}
+	return c.pc.RemoveTrack(sender)
+}
+
+// watchSenderRTCP はローカルトラックの RTPSender に届く RTCP フィードバックを読み続け、
+// PLI/FIR を受け取るたびに OnKeyFrameRequired を呼び出します。
+func (c *Connection) watchSenderRTCP(sender *webrtc.RTPSender) {
+	go func() {
+		for {
+			packets, err := sender.ReadRTCP()
+			if err != nil {
+				if err != io.EOF {
+					c.trace("read RTCP error on local track: %v", err)
+				}
+				return
+			}
+			for _, packet := range packets {
+				switch p := packet.(type) {
+				case *rtcp.PictureLossIndication:
+					c.onKeyFrameRequiredHandler(p.MediaSSRC)
+				case *rtcp.FullIntraRequest:
+					for _, entry := range p.FIR {
+						c.onKeyFrameRequiredHandler(entry.SSRC)
+					}
+				case *rtcp.TransportLayerNack:
+					c.trace("received NACK for ssrc %d", p.MediaSSRC)
+				}
+			}
+		}
+	}()
+}
+
 func (c *Connection) sendOffer() error {
 	if c.pc == nil {
 		return nil
@@ -377,9 +728,53 @@ func (c *Connection) setAnswer(sessionDescription webrtc.SessionDescription) err
 		return err
 	}
 	c.trace("set answer sdp=%s", sessionDescription.SDP)
+	if err := c.validateNegotiatedCodecs(sessionDescription.SDP); err != nil {
+		// Disconnect() はハンドラをクリアするので、その前にユーザーのハンドラを退避しておく
+		c.callbackMu.Lock()
+		onDisconnect := c.onDisconnectHandler
+		c.callbackMu.Unlock()
+		c.Disconnect()
+		onDisconnect("UNSUPPORTED-CODEC", err)
+		return err
+	}
+	c.flushPendingCandidates()
 	return nil
 }
 
+// validateNegotiatedCodecs は SDP の a=rtpmap 行に Options.Video.Codec / Options.Audio.Codec が
+// 含まれているかを確認し、含まれていなければ UnsupportedCodecError を返します。
+// これにより、コーデックの不一致がサイレントなネゴシエーション失敗ではなく
+// 型付きのエラーとして表面化します。pion は SDP 上のコーデック名を小文字（例: "opus"）で
+// 書き出すため、大文字小文字を区別せずに比較します。
+func (c *Connection) validateNegotiatedCodecs(sdp string) error {
+	if c.Options.Video.Enabled && c.Options.Video.Codec != "" && !sdpHasRtpmapCodec(sdp, c.Options.Video.Codec) {
+		return &UnsupportedCodecError{Kind: "video", Codec: c.Options.Video.Codec}
+	}
+	if c.Options.Audio.Enabled && c.Options.Audio.Codec != "" && !sdpHasRtpmapCodec(sdp, c.Options.Audio.Codec) {
+		return &UnsupportedCodecError{Kind: "audio", Codec: c.Options.Audio.Codec}
+	}
+	return nil
+}
+
+// sdpHasRtpmapCodec は SDP の "a=rtpmap:<payload type> <codec>/<clock rate>..." 行を走査し、
+// 指定したコーデック名（大文字小文字を区別しない）を持つ行があるかどうかを返します。
+func sdpHasRtpmapCodec(sdp string, codec string) bool {
+	for _, line := range strings.Split(sdp, "\r\n") {
+		if !strings.HasPrefix(line, "a=rtpmap:") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.SplitN(fields[1], "/", 2)[0]
+		if strings.EqualFold(name, codec) {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Connection) setOffer(sessionDescription webrtc.SessionDescription) error {
 	if c.pc == nil {
 		return nil
@@ -391,6 +786,16 @@ func (c *Connection) setOffer(sessionDescription webrtc.SessionDescription) erro
 		return err
 	}
 	c.trace("set offer sdp=%s", sessionDescription.SDP)
+	if err := c.validateNegotiatedCodecs(sessionDescription.SDP); err != nil {
+		// Disconnect() はハンドラをクリアするので、その前にユーザーのハンドラを退避しておく
+		c.callbackMu.Lock()
+		onDisconnect := c.onDisconnectHandler
+		c.callbackMu.Unlock()
+		c.Disconnect()
+		onDisconnect("UNSUPPORTED-CODEC", err)
+		return err
+	}
+	c.flushPendingCandidates()
 	err = c.createAnswer()
 	if err != nil {
 		return err
@@ -398,17 +803,47 @@ func (c *Connection) setOffer(sessionDescription webrtc.SessionDescription) erro
 	return nil
 }
 
+// addICECandidate は受信した ICE candidate を PeerConnection に追加します。
+// SetRemoteDescription が完了する前に届いた candidate は AddICECandidate がエラーになるため、
+// pendingCandidates に溜めておき flushPendingCandidates で後から流し込みます。
 func (c *Connection) addICECandidate(candidate webrtc.ICECandidateInit) {
 	if c.pc == nil {
 		return
 	}
-	err := c.pc.AddICECandidate(candidate)
-	if err != nil {
+
+	c.candidateMu.Lock()
+	if !c.remoteDescriptionSet {
+		c.pendingCandidates = append(c.pendingCandidates, candidate)
+		c.candidateMu.Unlock()
+		return
+	}
+	c.candidateMu.Unlock()
+
+	if err := c.pc.AddICECandidate(candidate); err != nil {
 		c.trace("invalid ice candidate, %v", candidate)
 		// ignore error
 	}
 }
 
+func (c *Connection) flushPendingCandidates() {
+	if c.pc == nil {
+		return
+	}
+
+	c.candidateMu.Lock()
+	c.remoteDescriptionSet = true
+	candidates := c.pendingCandidates
+	c.pendingCandidates = nil
+	c.candidateMu.Unlock()
+
+	for _, candidate := range candidates {
+		if err := c.pc.AddICECandidate(candidate); err != nil {
+			c.trace("invalid ice candidate, %v", candidate)
+			// ignore error
+		}
+	}
+}
+
 func (c *Connection) closePeerConnection() {
 	if c.pc == nil {
 		return
@@ -467,7 +902,7 @@ loop:
 	}
 }
 
-func (c *Connection) recv(ctx context.Context, messageChannel chan []byte) {
+func (c *Connection) recv(ctx context.Context, messageChannel chan []byte, generation int) {
 loop:
 	for {
 		if c.ws == nil {
@@ -487,8 +922,7 @@ loop:
 	c.trace("CLOSE-MESSAGE-CHANNEL")
 	<-ctx.Done()
 	c.trace("EXITED-MAIN")
-	c.Disconnect()
-	c.onDisconnectHandler("EXIT-RECV", nil)
+	c.handleFatalError("EXIT-RECV", nil, generation)
 	c.trace("EXIT-RECV")
 }
 
@@ -547,7 +981,15 @@ func (c *Connection) handleMessage(rawMessage []byte) error {
 		if rejectReason == "" {
 			rejectReason = "REJECTED"
 		}
-		c.Disconnect()
+		// reject は一時的な障害ではなく終端状態なので、再接続中であってもループを打ち切る
+		c.callbackMu.Lock()
+		reconnecting := c.reconnecting
+		c.callbackMu.Unlock()
+		if reconnecting {
+			c.handleTerminalReject(rejectReason)
+			return nil
+		}
+		c.disconnect(true)
 		c.onDisconnectHandler(rejectReason, nil)
 	case "offer":
 		offerMsg := webrtc.SessionDescription{}
@@ -555,7 +997,32 @@ func (c *Connection) handleMessage(rawMessage []byte) error {
 			return err
 		}
 		if c.pc != nil && c.pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+			// glare: この状態で SetRemoteDescription(offer) を呼ぶと HaveLocalOffer から
+			// 抜けられず pion v2 にロールバックもないため setOffer がエラーになる。
+			// 受信した offer を受け入れるには PeerConnection を再構築するしかない。
+			// 旧 PeerConnection 上の DataChannel オブジェクト自体は失われるが、こちら側で
+			// CreateDataChannel していたものは label/init を使って新しい PeerConnection 上に
+			// 作り直し、OnDataChannel 経由で通知することで実質的に引き継ぐ
+			c.dataChannelMu.Lock()
+			stale := c.dataChannels
+			c.dataChannels = nil
+			c.dataChannelMu.Unlock()
+
 			c.createPeerConnection()
+
+			for _, state := range stale {
+				if state.init == nil {
+					c.trace("glare: dropping remote-created data channel %q, remote will recreate it", state.label)
+					continue
+				}
+				dc, err := c.CreateDataChannel(state.label, state.init)
+				if err != nil {
+					c.trace("glare: failed to recreate data channel %q: %v", state.label, err)
+					continue
+				}
+				c.trace("glare: recreated data channel %q on rebuilt PeerConnection", state.label)
+				c.onDataChannelHandler(dc)
+			}
 		}
 		return c.setOffer(offerMsg)
 	case "answer":
@@ -18,14 +18,22 @@ type ConnectionOptions struct {
 
 	// 認証が必要なルームへの接続時に必要なシグナリングキー
 	SignalingKey string
+
+	// MediaEngine へのコーデック登録処理。未指定時は defaultCodecRegistrar が使われ、
+	// Video.Codec / Audio.Codec に応じて VP8/VP9/H264、Opus/G722/PCMU/PCMA から選択して
+	// 登録します（両方未指定時は VP8 + Opus）
+	CodecRegistrar CodecRegistrar
 }
 
 // ConnectionVideoOption は Video に関するオプションです。
 type ConnectionVideoOption struct {
-	// コーデックの設定。現在、'VP8' のみサポート
+	// コーデックの設定。未指定時は 'VP8'。既定の CodecRegistrar は 'VP8'、'VP9'、'H264' をサポート
 	Codec string
 
-	// 送受信方向。現在、'recvonly' のみサポート
+	// コーデックのペイロードタイプ。0 の場合は pion の既定値が使われます
+	PayloadType uint8
+
+	// 送受信方向。'recvonly'、'sendonly'、'sendrecv' が指定できます。未指定時は 'recvonly' として扱います
 	Direction string
 
 	// 有効かどうかのフラグ
@@ -34,7 +42,13 @@ type ConnectionVideoOption struct {
 
 // ConnectionAudioOption は Audio に関数するオプションです。
 type ConnectionAudioOption struct {
-	// 送受信方向。現在、'recvonly' のみサポート
+	// コーデックの設定。未指定時は 'OPUS'。既定の CodecRegistrar は 'OPUS'、'G722'、'PCMU'、'PCMA' をサポート
+	Codec string
+
+	// コーデックのペイロードタイプ。0 の場合は pion の既定値が使われます
+	PayloadType uint8
+
+	// 送受信方向。'recvonly'、'sendonly'、'sendrecv' が指定できます。未指定時は 'recvonly' として扱います
 	Direction string
 
 	// 有効かどうかのフラグ
@@ -0,0 +1,209 @@
+package ayame
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy は EXIT-RECV / READ-RTP-ERROR / ICE-CONNECTION-STATE-FAILED が
+// 発生した際の自動再接続の挙動を制御します。Connection.ReconnectPolicy が nil の場合、
+// これらのイベントは従来通り即座に OnDisconnect を呼び出します。
+type ReconnectPolicy struct {
+	// 最大リトライ回数。0 の場合は無制限にリトライします
+	MaxAttempts int
+
+	// 最初のリトライまでの待ち時間
+	InitialBackoff time.Duration
+
+	// リトライ間隔の上限
+	MaxBackoff time.Duration
+
+	// バックオフ時間に対して 0.0-1.0 の範囲でランダムな揺らぎを加えます
+	Jitter float64
+}
+
+// backoff は 0-indexed の attempt 回目のリトライまでの待ち時間を計算します。
+// MaxBackoff が 0 以下の場合は上限なしとして扱います。
+func (p *ReconnectPolicy) backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 0; i < attempt; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			d = p.MaxBackoff
+			break
+		}
+	}
+	if p.Jitter <= 0 {
+		return d
+	}
+	delta := float64(d) * p.Jitter
+	return d - time.Duration(delta) + time.Duration(rand.Float64()*2*delta)
+}
+
+// reconnectTerminalError は reject のように再接続を打ち切るべき終端状態を表す内部エラーです。
+type reconnectTerminalError struct {
+	reason string
+}
+
+func (e *reconnectTerminalError) Error() string {
+	return e.reason
+}
+
+// errReconnectSuccess は reconnectOutcome へ再接続成功を通知するための番兵です。
+// EXIT-RECV や ICE-CONNECTION-STATE-FAILED は err に nil を伴って発生することがあるため、
+// 成功を nil で表すと失敗と区別できなくなります。そのため成功は必ずこの番兵で表します。
+var errReconnectSuccess = errors.New("ayame: reconnect succeeded")
+
+// OnReconnecting は再接続を試みるたびに発生するコールバック関数を設定します。attempt は 1 始まりです。
+func (c *Connection) OnReconnecting(f func(attempt int, err error)) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.onReconnectingHandler = f
+}
+
+// OnReconnected は再接続に成功した際のコールバック関数を設定します。
+func (c *Connection) OnReconnected(f func()) {
+	c.callbackMu.Lock()
+	defer c.callbackMu.Unlock()
+	c.onReconnectedHandler = f
+}
+
+// handleFatalError は EXIT-RECV / READ-RTP-ERROR / ICE-CONNECTION-STATE-FAILED をまとめて処理します。
+// ReconnectPolicy が設定されていれば reconnectLoop を開始し、そうでなければ従来通り
+// disconnect して OnDisconnect を呼び出します。Disconnect() や bye によって接続が
+// 意図的に閉じられた後（c.closed）は、teardown に伴って発生したこれらのイベントを
+// 無視し、reconnectLoop を起動しません。generation は呼び出し元の recv()/pc コールバックが
+// 開始した時点の世代です。reconnectLoop が disconnect(false) で古い ws/pc を意図的に
+// 畳んだ後に、その世代からの EXIT-RECV 等が遅れて届いた場合は現在の世代と一致しないため無視します。
+func (c *Connection) handleFatalError(reason string, err error, generation int) {
+	c.callbackMu.Lock()
+	closed := c.closed
+	current := c.generation
+	c.callbackMu.Unlock()
+	if closed {
+		c.trace("handleFatalError: ignoring %s, connection was intentionally closed", reason)
+		return
+	}
+	if generation != current {
+		c.trace("handleFatalError: ignoring stale %s from generation %d (current %d)", reason, generation, current)
+		return
+	}
+
+	if c.ReconnectPolicy == nil {
+		// disconnect(true) はハンドラをクリアするので、その前にユーザーのハンドラを退避しておく
+		c.callbackMu.Lock()
+		onDisconnect := c.onDisconnectHandler
+		c.callbackMu.Unlock()
+		c.disconnect(true)
+		onDisconnect(reason, err)
+		return
+	}
+
+	c.callbackMu.Lock()
+	if c.reconnecting {
+		outcome := c.reconnectOutcome
+		c.callbackMu.Unlock()
+		if outcome != nil {
+			select {
+			case outcome <- err:
+			default:
+			}
+		}
+		return
+	}
+	c.reconnecting = true
+	c.reconnectOutcome = make(chan error, 1)
+	c.callbackMu.Unlock()
+
+	go c.reconnectLoop(reason, err)
+}
+
+// handleTerminalReject は再接続中に reject を受信した際に呼ばれ、reconnectLoop に
+// リトライを打ち切らせます。
+func (c *Connection) handleTerminalReject(reason string) {
+	c.callbackMu.Lock()
+	outcome := c.reconnectOutcome
+	c.callbackMu.Unlock()
+	if outcome == nil {
+		return
+	}
+	select {
+	case outcome <- &reconnectTerminalError{reason: reason}:
+	default:
+	}
+}
+
+// reconnectLoop は websocket の再オープン、sendRegisterMessage の再送、PeerConnection の
+// 再構築をバックオフを挟みながら繰り返します。OnOpen/OnConnect/OnDisconnect/OnTrackPacket/OnBye
+// などユーザーが設定したコールバックは disconnect(false) により保持されたままです。
+func (c *Connection) reconnectLoop(reason string, lastErr error) {
+	policy := c.ReconnectPolicy
+	attempt := 0
+	for {
+		c.callbackMu.Lock()
+		closed := c.closed
+		c.callbackMu.Unlock()
+		if closed {
+			c.trace("reconnect: cancelled by Disconnect")
+			return
+		}
+
+		if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			c.trace("reconnect: giving up after %d attempt(s): %v", attempt, lastErr)
+			break
+		}
+
+		c.onReconnectingHandler(attempt+1, lastErr)
+		time.Sleep(policy.backoff(attempt))
+		attempt++
+
+		c.callbackMu.Lock()
+		closed = c.closed
+		c.callbackMu.Unlock()
+		if closed {
+			c.trace("reconnect: cancelled by Disconnect")
+			return
+		}
+
+		c.disconnect(false)
+		if err := c.signaling(); err != nil {
+			c.trace("reconnect: signaling failed: %v", err)
+			lastErr = err
+			continue
+		}
+
+		outcome := <-c.reconnectOutcome
+		if outcome == errReconnectSuccess {
+			c.trace("reconnect: succeeded after %d attempt(s)", attempt)
+			c.callbackMu.Lock()
+			c.reconnecting = false
+			c.callbackMu.Unlock()
+			c.onReconnectedHandler()
+			return
+		}
+		if term, ok := outcome.(*reconnectTerminalError); ok {
+			c.callbackMu.Lock()
+			c.reconnecting = false
+			closed = c.closed
+			c.callbackMu.Unlock()
+			if closed {
+				// Disconnect() が既に disconnect(true) とハンドラのクリアを行っているので、
+				// ここでは何もせずループを抜ける
+				c.trace("reconnect: cancelled by Disconnect")
+				return
+			}
+			c.trace("reconnect: aborted by reject: %s", term.reason)
+			c.disconnect(true)
+			c.onDisconnectHandler(term.reason, nil)
+			return
+		}
+		lastErr = outcome
+	}
+
+	c.callbackMu.Lock()
+	c.reconnecting = false
+	c.callbackMu.Unlock()
+	c.disconnect(true)
+	c.onDisconnectHandler(reason, lastErr)
+}